@@ -0,0 +1,175 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collector implements an HTTP collector that a reporting origin can run to
+// receive aggregatable reports at the well-known endpoints defined by the Attribution
+// Reporting and Private Aggregation APIs. Received reports are written to disk grouped
+// by reporting origin and API, ready to be picked up and converted into the
+// pb.AggregatablePayload records the aggregation pipelines consume.
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/privacy-sandbox-aggregation-service/shared"
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+// Endpoints are the well-known paths the collector serves.
+var Endpoints = []string{
+	reporttypes.EndpointAttributionReporting,
+	reporttypes.EndpointPrivateAggregationProtectedAudience,
+	reporttypes.EndpointPrivateAggregationSharedStorage,
+}
+
+// Collector receives aggregatable reports over HTTP and writes the raw report bodies
+// under OutputDir, grouped by reporting origin and API:
+// OutputDir/<reporting-origin>/<api>/<sequence-number>.json
+type Collector struct {
+	OutputDir string
+
+	// writeMu serializes writeRawReport so concurrent requests landing in the same
+	// <reporting-origin>/<api> directory don't race on nextSequenceNumber and pick the
+	// same file name.
+	writeMu sync.Mutex
+}
+
+// New creates a Collector that writes received reports under outputDir.
+func New(outputDir string) *Collector {
+	return &Collector{OutputDir: outputDir}
+}
+
+// RegisterHandlers attaches the collector's well-known endpoints to mux.
+func (c *Collector) RegisterHandlers(mux *http.ServeMux) {
+	for _, endpoint := range Endpoints {
+		mux.HandleFunc("/"+endpoint, c.handleReport)
+	}
+}
+
+func (c *Collector) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := reporttypes.ParseReport(r.URL.Path, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := report.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.writeRawReport(report, body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeRawReport persists the report body under OutputDir/<reporting-origin>/<api>/.
+//
+// The file name is derived from the directory's own contents rather than an in-process
+// counter, so a restarted collector picks up where a prior run left off instead of
+// reusing sequence numbers and overwriting reports that haven't been ingested yet.
+func (c *Collector) writeRawReport(report reporttypes.Report, body []byte) error {
+	origin, api, err := reportOriginAndAPI(report)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(c.OutputDir, origin, api)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	seq, err := nextSequenceNumber(dir)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.json", seq)
+	return ioutil.WriteFile(filepath.Join(dir, name), body, 0o644)
+}
+
+// nextSequenceNumber scans dir for the largest "<n>.json" file already present and
+// returns n+1, so sequence numbers survive a collector restart.
+func nextSequenceNumber(dir string) (uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var max uint64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq > max {
+			max = seq
+		}
+	}
+	return max + 1, nil
+}
+
+// reportOriginAndAPI parses a report's shared_info to determine the reporting origin and
+// the Privacy Sandbox API that produced it.
+func reportOriginAndAPI(report reporttypes.Report) (origin, api string, err error) {
+	switch r := report.(type) {
+	case *reporttypes.AggregatableReport:
+		var info reporttypes.SharedInfo
+		if err := json.Unmarshal([]byte(r.SharedInfo), &info); err != nil {
+			return "", "", fmt.Errorf("parsing shared_info: %v", err)
+		}
+		return info.ReportingOrigin, reporttypes.APIAttributionReporting, nil
+	case *reporttypes.PrivateAggregationReport:
+		var info reporttypes.PrivateAggregationSharedInfo
+		if err := json.Unmarshal([]byte(r.SharedInfo), &info); err != nil {
+			return "", "", fmt.Errorf("parsing shared_info: %v", err)
+		}
+		return info.ReportingOrigin, info.API, nil
+	default:
+		return "", "", fmt.Errorf("unsupported report type %T", report)
+	}
+}
+
+// ConvertToAggregatablePayloads extracts the pb.AggregatablePayload records the
+// aggregation pipelines consume from a raw report previously written by the collector.
+// If verifiers is non-nil, the report's payload envelopes are verified first.
+func ConvertToAggregatablePayloads(report reporttypes.Report, useCleartext bool, verifiers reporttypes.OriginVerifiers) ([]*pb.AggregatablePayload, error) {
+	return report.ExtractPayloadsFromAggregatableReport(useCleartext, verifiers)
+}
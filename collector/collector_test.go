@@ -0,0 +1,166 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/privacy-sandbox-aggregation-service/shared"
+)
+
+func attributionReportJSON(reportID, reportingOrigin string) []byte {
+	return []byte(`{
+		"source_site": "https://source.test",
+		"attribution_destination": "https://destination.test",
+		"shared_info": "{\"scheduled_report_time\":\"1\",\"version\":\"1\",\"report_id\":\"` + reportID + `\",\"reporting_origin\":\"` + reportingOrigin + `\"}",
+		"aggregation_service_payloads": [{"payload": "AA==", "key_id": "key1"}]
+	}`)
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+
+	outputDir, err := ioutil.TempDir("/tmp", "test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
+
+	mux := http.NewServeMux()
+	New(outputDir).RegisterHandlers(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, outputDir
+}
+
+func TestHandleReportWritesRawReport(t *testing.T) {
+	server, outputDir := newTestServer(t)
+
+	body := attributionReportJSON("r1", "https://reporter.test")
+	resp, err := http.Post(server.URL+"/"+reporttypes.EndpointAttributionReporting, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("POST status = %d, want %d", got, want)
+	}
+
+	path := filepath.Join(outputDir, "https://reporter.test", reporttypes.APIAttributionReporting, "1.json")
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading written report at %s: %v", path, err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("written report = %s, want %s", got, body)
+	}
+}
+
+func TestHandleReportRejectsNonPOST(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, err := http.Get(server.URL + "/" + reporttypes.EndpointAttributionReporting)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("GET status = %d, want %d", got, want)
+	}
+}
+
+func TestHandleReportRejectsMalformedBody(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, err := http.Post(server.URL+"/"+reporttypes.EndpointAttributionReporting, "application/json", bytes.NewReader([]byte("not json")))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("POST status = %d, want %d", got, want)
+	}
+}
+
+func TestHandleReportGroupsByOriginAndAPI(t *testing.T) {
+	server, outputDir := newTestServer(t)
+
+	for _, origin := range []string{"https://a.test", "https://b.test"} {
+		body := attributionReportJSON("r1", origin)
+		resp, err := http.Post(server.URL+"/"+reporttypes.EndpointAttributionReporting, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	for _, origin := range []string{"https://a.test", "https://b.test"} {
+		path := filepath.Join(outputDir, origin, reporttypes.APIAttributionReporting, "1.json")
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected report written at %s: %v", path, err)
+		}
+	}
+}
+
+func TestWriteRawReportResumesSequenceAfterRestart(t *testing.T) {
+	outputDir, err := ioutil.TempDir("/tmp", "test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	report := &reporttypes.AggregatableReport{
+		SharedInfo: `{"scheduled_report_time":"1","version":"1","report_id":"r1","reporting_origin":"https://reporter.test"}`,
+	}
+
+	first := New(outputDir)
+	if err := first.writeRawReport(report, []byte("first")); err != nil {
+		t.Fatalf("writeRawReport() failed: %v", err)
+	}
+
+	// A fresh Collector, simulating a process restart, must not reuse the sequence
+	// number the previous instance already wrote.
+	restarted := New(outputDir)
+	if err := restarted.writeRawReport(report, []byte("second")); err != nil {
+		t.Fatalf("writeRawReport() failed: %v", err)
+	}
+
+	dir := filepath.Join(outputDir, "https://reporter.test", reporttypes.APIAttributionReporting)
+	gotFirst, err := ioutil.ReadFile(filepath.Join(dir, "1.json"))
+	if err != nil {
+		t.Fatalf("reading 1.json: %v", err)
+	}
+	if got, want := string(gotFirst), "first"; got != want {
+		t.Errorf("1.json = %q, want %q (must not be overwritten after restart)", got, want)
+	}
+
+	second, err := ioutil.ReadFile(filepath.Join(dir, "2.json"))
+	if err != nil {
+		t.Fatalf("reading 2.json: %v", err)
+	}
+	if got, want := string(second), "second"; got != want {
+		t.Errorf("2.json = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package envelope implements a Dead Simple Signing Envelope (DSSE) wrapper for
+// aggregatable payloads, letting helpers and aggregators verify a reporting origin's
+// signature over a payload before decryption and MPC processing.
+// https://github.com/secure-systems-lab/dsse
+package envelope
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// PayloadType identifies the content of an Envelope's Payload: the encrypted,
+// CBOR-serialized payload bytes carried by an AggregationServicePayload.
+const PayloadType = "application/vnd.privacy-sandbox.aggregatable+cbor"
+
+// Envelope is a Dead Simple Signing Envelope wrapping an aggregatable payload.
+type Envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     string      `json:"payload"` // base64-encoded
+	Signatures  []Signature `json:"signatures"`
+}
+
+// Signature is one signer's signature over the envelope's Pre-Authentication Encoding.
+type Signature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"` // base64-encoded
+}
+
+// Signer produces a signature over a Pre-Authentication Encoding.
+type Signer interface {
+	KeyID() string
+	Sign(pae []byte) ([]byte, error)
+}
+
+// Verifier checks a signature over a Pre-Authentication Encoding.
+type Verifier interface {
+	KeyID() string
+	Verify(pae, sig []byte) error
+}
+
+// PAE computes the DSSE Pre-Authentication Encoding for payloadType and payload:
+//
+//	"DSSEv1" SP len(payloadType) SP payloadType SP len(payload) SP payload
+//
+// The signature is computed over the PAE rather than the raw payload so that the
+// payload type itself is authenticated along with the bytes.
+func PAE(payloadType string, payload []byte) []byte {
+	pae := fmt.Sprintf("DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	return append([]byte(pae), payload...)
+}
+
+// SignEnvelope wraps payload in an Envelope and signs its PAE with each of signers,
+// producing one detached signature per signer.
+func SignEnvelope(payload []byte, signers ...Signer) (*Envelope, error) {
+	if len(signers) == 0 {
+		return nil, errors.New("at least one signer is required")
+	}
+
+	pae := PAE(PayloadType, payload)
+	env := &Envelope{
+		PayloadType: PayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+	}
+	for _, signer := range signers {
+		sig, err := signer.Sign(pae)
+		if err != nil {
+			return nil, fmt.Errorf("signing with key %q: %v", signer.KeyID(), err)
+		}
+		env.Signatures = append(env.Signatures, Signature{
+			KeyID: signer.KeyID(),
+			Sig:   base64.StdEncoding.EncodeToString(sig),
+		})
+	}
+	return env, nil
+}
+
+// VerifyEnvelope checks that at least one signature on env validates against a verifier
+// registered under that signature's KeyID in verifiers, and returns the decoded payload.
+func VerifyEnvelope(env *Envelope, verifiers map[string]Verifier) ([]byte, error) {
+	if env.PayloadType != PayloadType {
+		return nil, fmt.Errorf("unexpected payload type %q", env.PayloadType)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decoding payload: %v", err)
+	}
+	pae := PAE(env.PayloadType, payload)
+
+	var lastErr error
+	for _, sig := range env.Signatures {
+		verifier, ok := verifiers[sig.KeyID]
+		if !ok {
+			continue
+		}
+		decodedSig, err := base64.StdEncoding.DecodeString(sig.Sig)
+		if err != nil {
+			lastErr = fmt.Errorf("decoding signature for key %q: %v", sig.KeyID, err)
+			continue
+		}
+		if err := verifier.Verify(pae, decodedSig); err != nil {
+			lastErr = fmt.Errorf("verifying signature for key %q: %v", sig.KeyID, err)
+			continue
+		}
+		return payload, nil
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errors.New("no registered key matched any signature on the envelope")
+}
+
+// Ed25519Signer signs envelopes with an Ed25519 private key.
+type Ed25519Signer struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// NewEd25519Signer creates an Ed25519Signer identified by keyID.
+func NewEd25519Signer(keyID string, key ed25519.PrivateKey) *Ed25519Signer {
+	return &Ed25519Signer{keyID: keyID, key: key}
+}
+
+// KeyID returns the signer's key identifier.
+func (s *Ed25519Signer) KeyID() string { return s.keyID }
+
+// Sign signs pae with the Ed25519 private key.
+func (s *Ed25519Signer) Sign(pae []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, pae), nil
+}
+
+// Ed25519Verifier verifies envelopes signed with an Ed25519 public key.
+type Ed25519Verifier struct {
+	keyID string
+	key   ed25519.PublicKey
+}
+
+// NewEd25519Verifier creates an Ed25519Verifier identified by keyID.
+func NewEd25519Verifier(keyID string, key ed25519.PublicKey) *Ed25519Verifier {
+	return &Ed25519Verifier{keyID: keyID, key: key}
+}
+
+// KeyID returns the verifier's key identifier.
+func (v *Ed25519Verifier) KeyID() string { return v.keyID }
+
+// Verify checks sig against pae.
+func (v *Ed25519Verifier) Verify(pae, sig []byte) error {
+	if !ed25519.Verify(v.key, pae, sig) {
+		return errors.New("ed25519 signature verification failed")
+	}
+	return nil
+}
+
+// ECDSAP256Signer signs envelopes with an ECDSA P-256 private key, over the SHA-256
+// digest of the PAE.
+type ECDSAP256Signer struct {
+	keyID string
+	key   *ecdsa.PrivateKey
+}
+
+// NewECDSAP256Signer creates an ECDSAP256Signer identified by keyID.
+func NewECDSAP256Signer(keyID string, key *ecdsa.PrivateKey) *ECDSAP256Signer {
+	return &ECDSAP256Signer{keyID: keyID, key: key}
+}
+
+// KeyID returns the signer's key identifier.
+func (s *ECDSAP256Signer) KeyID() string { return s.keyID }
+
+// Sign signs pae with the ECDSA P-256 private key.
+func (s *ECDSAP256Signer) Sign(pae []byte) ([]byte, error) {
+	digest := sha256.Sum256(pae)
+	return ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+}
+
+// ECDSAP256Verifier verifies envelopes signed with an ECDSA P-256 public key.
+type ECDSAP256Verifier struct {
+	keyID string
+	key   *ecdsa.PublicKey
+}
+
+// NewECDSAP256Verifier creates an ECDSAP256Verifier identified by keyID.
+func NewECDSAP256Verifier(keyID string, key *ecdsa.PublicKey) *ECDSAP256Verifier {
+	return &ECDSAP256Verifier{keyID: keyID, key: key}
+}
+
+// KeyID returns the verifier's key identifier.
+func (v *ECDSAP256Verifier) KeyID() string { return v.keyID }
+
+// Verify checks sig against pae.
+func (v *ECDSAP256Verifier) Verify(pae, sig []byte) error {
+	digest := sha256.Sum256(pae)
+	if !ecdsa.VerifyASN1(v.key, digest[:], sig) {
+		return errors.New("ecdsa signature verification failed")
+	}
+	return nil
+}
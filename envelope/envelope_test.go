@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSignAndVerifyEnvelopeEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() failed: %v", err)
+	}
+
+	payload := []byte("aggregatable payload")
+	env, err := SignEnvelope(payload, NewEd25519Signer("key1", priv))
+	if err != nil {
+		t.Fatalf("SignEnvelope() failed: %v", err)
+	}
+
+	got, err := VerifyEnvelope(env, map[string]Verifier{"key1": NewEd25519Verifier("key1", pub)})
+	if err != nil {
+		t.Fatalf("VerifyEnvelope() failed: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("VerifyEnvelope() = %q, want %q", got, payload)
+	}
+}
+
+func TestSignAndVerifyEnvelopeECDSAP256(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() failed: %v", err)
+	}
+
+	payload := []byte("aggregatable payload")
+	env, err := SignEnvelope(payload, NewECDSAP256Signer("key1", priv))
+	if err != nil {
+		t.Fatalf("SignEnvelope() failed: %v", err)
+	}
+
+	got, err := VerifyEnvelope(env, map[string]Verifier{"key1": NewECDSAP256Verifier("key1", &priv.PublicKey)})
+	if err != nil {
+		t.Fatalf("VerifyEnvelope() failed: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("VerifyEnvelope() = %q, want %q", got, payload)
+	}
+}
+
+func TestVerifyEnvelopeRejectsTamperedSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() failed: %v", err)
+	}
+
+	env, err := SignEnvelope([]byte("aggregatable payload"), NewEd25519Signer("key1", priv))
+	if err != nil {
+		t.Fatalf("SignEnvelope() failed: %v", err)
+	}
+	env.Payload = "dGFtcGVyZWQ=" // base64("tampered"), signature no longer matches.
+
+	if _, err := VerifyEnvelope(env, map[string]Verifier{"key1": NewEd25519Verifier("key1", pub)}); err == nil {
+		t.Error("VerifyEnvelope() succeeded on a tampered payload, want error")
+	}
+}
+
+func TestVerifyEnvelopeRejectsWrongPublicKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() failed: %v", err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() failed: %v", err)
+	}
+
+	env, err := SignEnvelope([]byte("aggregatable payload"), NewEd25519Signer("key1", priv))
+	if err != nil {
+		t.Fatalf("SignEnvelope() failed: %v", err)
+	}
+
+	if _, err := VerifyEnvelope(env, map[string]Verifier{"key1": NewEd25519Verifier("key1", otherPub)}); err == nil {
+		t.Error("VerifyEnvelope() succeeded with the wrong public key, want error")
+	}
+}
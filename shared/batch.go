@@ -0,0 +1,384 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporttypes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+// Partitioner buckets reports into Partitions before they are submitted to the
+// aggregation service, by API, reporting origin, scheduled_report_time window, and
+// privacy-budget-key. The report version is not part of a Partition; a Batch rejects a
+// report whose version differs from the reports already in it.
+// https://github.com/WICG/attribution-reporting-api/blob/main/AGGREGATION_SERVICE_TEE.md
+type Partitioner struct {
+	// Window is the size, in seconds, of the scheduled_report_time bucket a report is
+	// assigned to. A Window of zero or less leaves scheduled_report_time unfloored, so
+	// only reports with the same scheduled_report_time share a Partition.
+	Window int64
+}
+
+// Partition identifies the bucket a report falls into: reports sharing a Partition are
+// combined into one Batch.
+type Partition struct {
+	API                 string
+	ReportingOrigin     string
+	PrivacyBudgetKey    string
+	ScheduledReportTime int64
+}
+
+// floorScheduledReportTime parses scheduledReportTime and floors it to window, the way
+// Partitioner does when bucketing a report into a Partition.
+func floorScheduledReportTime(scheduledReportTime string, window int64) (int64, error) {
+	t, err := strconv.ParseInt(scheduledReportTime, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing scheduled_report_time %q: %v", scheduledReportTime, err)
+	}
+	if window > 0 {
+		t = (t / window) * window
+	}
+	return t, nil
+}
+
+// PartitionFor returns the partition the report with the given api and shared info
+// falls into, flooring its scheduled_report_time to the partitioner's window.
+func (p *Partitioner) PartitionFor(api string, info *SharedInfo) (Partition, error) {
+	scheduledReportTime, err := floorScheduledReportTime(info.ScheduledReportTime, p.Window)
+	if err != nil {
+		return Partition{}, err
+	}
+
+	return Partition{
+		API:                 api,
+		ReportingOrigin:     info.ReportingOrigin,
+		PrivacyBudgetKey:    info.PrivacyBudgetKey,
+		ScheduledReportTime: scheduledReportTime,
+	}, nil
+}
+
+// PartitionForReport returns the partition report falls into according to p, reading
+// whichever concrete SharedInfo shape the report carries.
+func (p *Partitioner) PartitionForReport(report Report) (Partition, error) {
+	api, meta, err := reportAPIAndMeta(report)
+	if err != nil {
+		return Partition{}, err
+	}
+
+	scheduledReportTime, err := floorScheduledReportTime(meta.ScheduledReportTime, p.Window)
+	if err != nil {
+		return Partition{}, err
+	}
+
+	return Partition{
+		API:                 api,
+		ReportingOrigin:     meta.ReportingOrigin,
+		PrivacyBudgetKey:    meta.PrivacyBudgetKey,
+		ScheduledReportTime: scheduledReportTime,
+	}, nil
+}
+
+// BatchReports buckets reports into Batches using p, creating one Batch per distinct
+// Partition encountered. This is the entry point that turns a stream of incoming
+// reports into the whole batches the Beam aggregation pipelines consume.
+func BatchReports(reports []Report, p *Partitioner) (map[Partition]*Batch, error) {
+	batches := make(map[Partition]*Batch)
+	for _, report := range reports {
+		partition, err := p.PartitionForReport(report)
+		if err != nil {
+			return nil, err
+		}
+
+		batch, ok := batches[partition]
+		if !ok {
+			batch = NewBatch(partition, p.Window)
+			batches[partition] = batch
+		}
+
+		if err := batch.AddReport(report); err != nil {
+			return nil, err
+		}
+	}
+	return batches, nil
+}
+
+// Batch accumulates the reports belonging to one Partition, validating that they are
+// consistent with each other and rejecting duplicates before handing their payloads to
+// the aggregators.
+type Batch struct {
+	Partition Partition
+
+	// window is the Partitioner.Window used to compute Partition, so AddReport can
+	// verify that each report's own scheduled_report_time floors into it.
+	window int64
+
+	version     string
+	protocol    string
+	reportIDs   map[string]bool
+	reportOrder []string
+	payloads    []*pb.AggregatablePayload
+}
+
+// NewBatch creates an empty Batch for the given partition. window must be the
+// Partitioner.Window used to compute partition.
+func NewBatch(partition Partition, window int64) *Batch {
+	return &Batch{
+		Partition: partition,
+		window:    window,
+		reportIDs: make(map[string]bool),
+	}
+}
+
+// reportMeta holds the shared_info fields that are common to both AggregatableReport
+// and PrivateAggregationReport, regardless of which concrete SharedInfo shape the
+// report uses.
+type reportMeta struct {
+	ScheduledReportTime string `json:"scheduled_report_time"`
+	PrivacyBudgetKey    string `json:"privacy_budget_key"`
+	Version             string `json:"version"`
+	ReportID            string `json:"report_id"`
+	ReportingOrigin     string `json:"reporting_origin"`
+}
+
+// reportAPIAndMeta parses report's shared_info, returning the API it belongs to
+// alongside the fields common to every report shape. It mirrors the type switch
+// collector.reportOriginAndAPI uses to tell report shapes apart.
+func reportAPIAndMeta(report Report) (api string, meta reportMeta, err error) {
+	switch r := report.(type) {
+	case *AggregatableReport:
+		if err := json.Unmarshal([]byte(r.SharedInfo), &meta); err != nil {
+			return "", reportMeta{}, fmt.Errorf("parsing shared_info: %v", err)
+		}
+		return APIAttributionReporting, meta, nil
+	case *PrivateAggregationReport:
+		var info PrivateAggregationSharedInfo
+		if err := json.Unmarshal([]byte(r.SharedInfo), &info); err != nil {
+			return "", reportMeta{}, fmt.Errorf("parsing shared_info: %v", err)
+		}
+		return info.API, reportMeta{
+			ScheduledReportTime: info.ScheduledReportTime,
+			PrivacyBudgetKey:    info.PrivacyBudgetKey,
+			Version:             info.Version,
+			ReportID:            info.ReportID,
+			ReportingOrigin:     info.ReportingOrigin,
+		}, nil
+	default:
+		return "", reportMeta{}, fmt.Errorf("unsupported report type %T", report)
+	}
+}
+
+// AddReport validates report against the batch's partition - same API, reporting
+// origin, privacy budget key, and scheduled_report_time window - and against the
+// reports already in the batch - same version, same protocol, and a ReportID not
+// already seen - before extracting and appending its payloads. report may be an
+// *AggregatableReport or a *PrivateAggregationReport, so a single Batch can hold
+// either API's reports.
+func (b *Batch) AddReport(report Report) error {
+	api, meta, err := reportAPIAndMeta(report)
+	if err != nil {
+		return err
+	}
+
+	if meta.ReportingOrigin != b.Partition.ReportingOrigin {
+		return fmt.Errorf("report reporting_origin %q does not match batch partition reporting origin %q", meta.ReportingOrigin, b.Partition.ReportingOrigin)
+	}
+	if api != b.Partition.API {
+		return fmt.Errorf("report api %q does not match batch partition api %q", api, b.Partition.API)
+	}
+	if meta.PrivacyBudgetKey != b.Partition.PrivacyBudgetKey {
+		return fmt.Errorf("report privacy_budget_key %q does not match batch partition privacy budget key %q", meta.PrivacyBudgetKey, b.Partition.PrivacyBudgetKey)
+	}
+
+	scheduledReportTime, err := floorScheduledReportTime(meta.ScheduledReportTime, b.window)
+	if err != nil {
+		return err
+	}
+	if scheduledReportTime != b.Partition.ScheduledReportTime {
+		return fmt.Errorf("report scheduled_report_time %d does not fall in batch partition scheduled_report_time window %d", scheduledReportTime, b.Partition.ScheduledReportTime)
+	}
+
+	if b.reportIDs[meta.ReportID] {
+		return fmt.Errorf("duplicate report_id %q", meta.ReportID)
+	}
+
+	protocol, err := report.GetProtocol()
+	if err != nil {
+		return err
+	}
+
+	if len(b.reportOrder) == 0 {
+		b.version = meta.Version
+		b.protocol = protocol
+	} else {
+		if meta.Version != b.version {
+			return fmt.Errorf("report version %q does not match batch version %q", meta.Version, b.version)
+		}
+		if protocol != b.protocol {
+			return fmt.Errorf("report protocol %q does not match batch protocol %q", protocol, b.protocol)
+		}
+	}
+
+	payloads, err := report.ExtractPayloadsFromAggregatableReport(false /*useCleartext*/, nil /*verifiers*/)
+	if err != nil {
+		return err
+	}
+
+	b.reportIDs[meta.ReportID] = true
+	b.reportOrder = append(b.reportOrder, meta.ReportID)
+	b.payloads = append(b.payloads, payloads...)
+	return nil
+}
+
+// Reports returns the number of reports added to the batch.
+func (b *Batch) Reports() int { return len(b.reportOrder) }
+
+// Merge combines other into b. Both batches must share the same partition, and, once
+// either has reports, the same version and protocol; duplicate report IDs are rejected.
+func (b *Batch) Merge(other *Batch) error {
+	if other.Partition != b.Partition {
+		return fmt.Errorf("cannot merge batch for partition %+v into batch for partition %+v", other.Partition, b.Partition)
+	}
+
+	if len(b.reportOrder) > 0 && len(other.reportOrder) > 0 {
+		if other.version != b.version {
+			return fmt.Errorf("report version %q does not match batch version %q", other.version, b.version)
+		}
+		if other.protocol != b.protocol {
+			return fmt.Errorf("report protocol %q does not match batch protocol %q", other.protocol, b.protocol)
+		}
+	}
+
+	for _, id := range other.reportOrder {
+		if b.reportIDs[id] {
+			return fmt.Errorf("duplicate report_id %q", id)
+		}
+	}
+
+	if len(b.reportOrder) == 0 {
+		b.version = other.version
+		b.protocol = other.protocol
+	}
+	for _, id := range other.reportOrder {
+		b.reportIDs[id] = true
+		b.reportOrder = append(b.reportOrder, id)
+	}
+	b.payloads = append(b.payloads, other.payloads...)
+	return nil
+}
+
+// Shard builds the on-disk unit of the batch: every payload in the batch, plus a
+// Manifest describing them for auditing. The payloads are not split per aggregation
+// server; for a batch of MPC reports the Shard holds the payloads for both servers.
+func (b *Batch) Shard() (*Shard, error) {
+	manifest, err := newManifest(b.reportOrder, b.payloads)
+	if err != nil {
+		return nil, err
+	}
+	return &Shard{Payloads: b.payloads, Manifest: manifest}, nil
+}
+
+// Shard is the on-disk unit of a Batch: all of its payloads and their Manifest.
+type Shard struct {
+	Payloads []*pb.AggregatablePayload
+	Manifest Manifest
+}
+
+// Manifest describes the contents of a Shard for auditing without needing to parse the
+// payloads themselves.
+type Manifest struct {
+	ReportCount   int      `json:"report_count"`
+	ReportIDs     []string `json:"report_ids"`
+	PayloadSHA256 string   `json:"payload_sha256"`
+}
+
+func newManifest(reportIDs []string, payloads []*pb.AggregatablePayload) (Manifest, error) {
+	var blob []byte
+	for _, payload := range payloads {
+		b, err := proto.Marshal(payload)
+		if err != nil {
+			return Manifest{}, err
+		}
+		blob = append(blob, b...)
+	}
+	sum := sha256.Sum256(blob)
+
+	return Manifest{
+		ReportCount:   len(reportIDs),
+		ReportIDs:     reportIDs,
+		PayloadSHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// manifestPath returns the path the manifest for the shard written at shardPath is
+// stored at.
+func manifestPath(shardPath string) string { return shardPath + ".manifest.json" }
+
+// WriteShard writes shard's payloads to shardPath, one base64-serialized
+// AggregatablePayload per line, and its manifest alongside it at shardPath + ".manifest.json".
+func WriteShard(shard *Shard, shardPath string) error {
+	lines := make([]string, len(shard.Payloads))
+	for i, payload := range shard.Payloads {
+		line, err := SerializeAggregatablePayload(payload)
+		if err != nil {
+			return err
+		}
+		lines[i] = line
+	}
+	if err := ioutil.WriteFile(shardPath, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		return err
+	}
+
+	manifestBytes, err := json.MarshalIndent(shard.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath(shardPath), manifestBytes, 0o644)
+}
+
+// ReadShard reads back a Shard previously written by WriteShard.
+func ReadShard(shardPath string) (*Shard, error) {
+	data, err := ioutil.ReadFile(shardPath)
+	if err != nil {
+		return nil, err
+	}
+
+	shard := &Shard{}
+	if len(data) > 0 {
+		for _, line := range strings.Split(string(data), "\n") {
+			payload, err := DeserializeAggregatablePayload(line)
+			if err != nil {
+				return nil, err
+			}
+			shard.Payloads = append(shard.Payloads, payload)
+		}
+	}
+
+	manifestBytes, err := ioutil.ReadFile(manifestPath(shardPath))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(manifestBytes, &shard.Manifest); err != nil {
+		return nil, err
+	}
+	return shard, nil
+}
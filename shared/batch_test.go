@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporttypes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+func testPartition() Partition {
+	return Partition{
+		API:                 APIAttributionReporting,
+		ReportingOrigin:     "https://reporter.test",
+		PrivacyBudgetKey:    "budget-key",
+		ScheduledReportTime: 100,
+	}
+}
+
+func testAggregatableReport(reportID, reportingOrigin string) *AggregatableReport {
+	return &AggregatableReport{
+		SharedInfo: `{"scheduled_report_time":"100","privacy_budget_key":"budget-key","version":"1","report_id":"` + reportID + `","reporting_origin":"` + reportingOrigin + `"}`,
+		AggregationServicePayloads: []*AggregationServicePayload{
+			{Payload: "AA==", KeyID: "key1"},
+		},
+	}
+}
+
+func TestBatchAddReportRejectsDuplicateReportID(t *testing.T) {
+	b := NewBatch(testPartition(), 0)
+
+	if err := b.AddReport(testAggregatableReport("r1", "https://reporter.test")); err != nil {
+		t.Fatalf("AddReport() failed: %v", err)
+	}
+	if err := b.AddReport(testAggregatableReport("r1", "https://reporter.test")); err == nil {
+		t.Error("AddReport() with a duplicate report_id succeeded, want error")
+	}
+}
+
+func TestBatchAddReportRejectsMismatchedReportingOrigin(t *testing.T) {
+	b := NewBatch(testPartition(), 0)
+
+	if err := b.AddReport(testAggregatableReport("r1", "https://reporter.test")); err != nil {
+		t.Fatalf("AddReport() failed: %v", err)
+	}
+	if err := b.AddReport(testAggregatableReport("r2", "https://other.test")); err == nil {
+		t.Error("AddReport() with a mismatched reporting_origin succeeded, want error")
+	}
+}
+
+func TestBatchAddReportRejectsMismatchedScheduledReportTime(t *testing.T) {
+	b := NewBatch(testPartition(), 50)
+
+	r := &AggregatableReport{
+		SharedInfo: `{"scheduled_report_time":"150","privacy_budget_key":"budget-key","version":"1","report_id":"r1","reporting_origin":"https://reporter.test"}`,
+		AggregationServicePayloads: []*AggregationServicePayload{
+			{Payload: "AA==", KeyID: "key1"},
+		},
+	}
+	if err := b.AddReport(r); err == nil {
+		t.Error("AddReport() with a report outside the batch's scheduled_report_time window succeeded, want error")
+	}
+}
+
+func TestBatchAddReportAcceptsPrivateAggregationReport(t *testing.T) {
+	partition := Partition{
+		API:                 APIProtectedAudience,
+		ReportingOrigin:     "https://reporter.test",
+		PrivacyBudgetKey:    "budget-key",
+		ScheduledReportTime: 100,
+	}
+	b := NewBatch(partition, 0)
+
+	r := &PrivateAggregationReport{
+		SharedInfo: `{"scheduled_report_time":"100","privacy_budget_key":"budget-key","version":"1","report_id":"r1","reporting_origin":"https://reporter.test","api":"protected-audience"}`,
+		AggregationServicePayloads: []*AggregationServicePayload{
+			{Payload: "AA==", KeyID: "key1"},
+		},
+	}
+	if err := b.AddReport(r); err != nil {
+		t.Fatalf("AddReport() failed: %v", err)
+	}
+	if got, want := b.Reports(), 1; got != want {
+		t.Errorf("Reports() = %d, want %d", got, want)
+	}
+}
+
+func TestPartitionerPartitionForReportFloorsScheduledReportTime(t *testing.T) {
+	p := &Partitioner{Window: 50}
+
+	got, err := p.PartitionForReport(testAggregatableReport("r1", "https://reporter.test"))
+	if err != nil {
+		t.Fatalf("PartitionForReport() failed: %v", err)
+	}
+
+	want := Partition{
+		API:                 APIAttributionReporting,
+		ReportingOrigin:     "https://reporter.test",
+		PrivacyBudgetKey:    "budget-key",
+		ScheduledReportTime: 100,
+	}
+	if got != want {
+		t.Errorf("PartitionForReport() = %+v, want %+v", got, want)
+	}
+}
+
+func TestBatchReportsGroupsByPartition(t *testing.T) {
+	p := &Partitioner{Window: 50}
+
+	reports := []Report{
+		testAggregatableReport("r1", "https://reporter.test"),
+		testAggregatableReport("r2", "https://reporter.test"),
+		testAggregatableReport("r3", "https://other.test"),
+	}
+
+	batches, err := BatchReports(reports, p)
+	if err != nil {
+		t.Fatalf("BatchReports() failed: %v", err)
+	}
+
+	if got, want := len(batches), 2; got != want {
+		t.Fatalf("BatchReports() produced %d batches, want %d", got, want)
+	}
+
+	same := Partition{API: APIAttributionReporting, ReportingOrigin: "https://reporter.test", PrivacyBudgetKey: "budget-key", ScheduledReportTime: 100}
+	other := Partition{API: APIAttributionReporting, ReportingOrigin: "https://other.test", PrivacyBudgetKey: "budget-key", ScheduledReportTime: 100}
+
+	if got, want := batches[same].Reports(), 2; got != want {
+		t.Errorf("batches[same].Reports() = %d, want %d", got, want)
+	}
+	if got, want := batches[other].Reports(), 1; got != want {
+		t.Errorf("batches[other].Reports() = %d, want %d", got, want)
+	}
+}
+
+func TestWriteReadShard(t *testing.T) {
+	fileDir, err := ioutil.TempDir("/tmp", "test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(fileDir)
+
+	want := &Shard{
+		Payloads: []*pb.AggregatablePayload{
+			{Payload: &pb.StandardCiphertext{Data: []byte("payload1")}, SharedInfo: "info1", KeyId: "key1"},
+			{Payload: &pb.StandardCiphertext{Data: []byte("payload2")}, SharedInfo: "info2", KeyId: "key2"},
+		},
+	}
+	want.Manifest, err = newManifest([]string{"r1", "r2"}, want.Payloads)
+	if err != nil {
+		t.Fatalf("newManifest() failed: %v", err)
+	}
+
+	shardPath := filepath.Join(fileDir, "shard")
+	if err := WriteShard(want, shardPath); err != nil {
+		t.Fatalf("WriteShard() failed: %v", err)
+	}
+
+	got, err := ReadShard(shardPath)
+	if err != nil {
+		t.Fatalf("ReadShard() failed: %v", err)
+	}
+
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("shard mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -17,12 +17,16 @@
 package reporttypes
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"google.golang.org/protobuf/proto"
 	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+	"github.com/google/privacy-sandbox-aggregation-service/envelope"
 )
 
 const (
@@ -31,6 +35,29 @@ const (
 	mpcProtocol      = "mpc"
 )
 
+const (
+	// APIAttributionReporting identifies reports generated by the Attribution Reporting API.
+	APIAttributionReporting = "attribution-reporting"
+	// APIProtectedAudience identifies Private Aggregation API reports generated by a
+	// Protected Audience worklet.
+	APIProtectedAudience = "protected-audience"
+	// APISharedStorage identifies Private Aggregation API reports generated by a
+	// Shared Storage worklet.
+	APISharedStorage = "shared-storage"
+)
+
+const (
+	// EndpointAttributionReporting is the well-known path browsers POST Attribution
+	// Reporting API aggregatable reports to.
+	EndpointAttributionReporting = ".well-known/attribution-reporting/report-aggregate-attribution"
+	// EndpointPrivateAggregationProtectedAudience is the well-known path browsers POST
+	// Private Aggregation API reports from Protected Audience to.
+	EndpointPrivateAggregationProtectedAudience = ".well-known/private-aggregation/report-protected-audience"
+	// EndpointPrivateAggregationSharedStorage is the well-known path browsers POST
+	// Private Aggregation API reports from Shared Storage to.
+	EndpointPrivateAggregationSharedStorage = ".well-known/private-aggregation/report-shared-storage"
+)
+
 // The struct tags in the following structs need to be consistent with the field names defined in:
 // https://github.com/WICG/conversion-measurement-api/blob/main/AGGREGATE.md#aggregate-attribution-reports
 
@@ -41,10 +68,32 @@ type AggregationServicePayload struct {
 	KeyID   string `json:"key_id"`
 	// Debug cleartext payload is empty for non-debug reports.
 	DebugCleartextPayload string `json:"debug_cleartext_payload"`
+	// Envelope, if present, is a DSSE envelope over the encrypted Payload bytes, letting
+	// the aggregation service verify the reporting origin's signature before decryption.
+	Envelope *envelope.Envelope `json:"envelope,omitempty"`
+}
+
+// OriginVerifiers maps a reporting origin to the envelope.Verifier that authenticates
+// the envelopes it signs, for use with ExtractPayloadsFromAggregatableReport.
+type OriginVerifiers map[string]envelope.Verifier
+
+// Report is implemented by every aggregatable report shape the aggregation service
+// accepts, regardless of which Privacy Sandbox API produced it.
+type Report interface {
+	// GetProtocol gets the protocol which the report uses.
+	GetProtocol() (string, error)
+	// Validate checks if a report is valid.
+	Validate() error
+	// ExtractPayloadsFromAggregatableReport extracts records to be processed by the aggregators.
+	// If verifiers is non-nil, every payload must carry an envelope that verifies against the
+	// Verifier registered for the report's reporting origin.
+	ExtractPayloadsFromAggregatableReport(useCleartext bool, verifiers OriginVerifiers) ([]*pb.AggregatablePayload, error)
 }
 
 // AggregatableReport contains the information generated by the browser from a key-value pair,
-// which will be used for server-side aggregation.
+// which will be used for server-side aggregation. It is the report shape used by the
+// Attribution Reporting API; see PrivateAggregationReport for the Protected Audience and
+// Shared Storage shape.
 type AggregatableReport struct {
 	SourceSite             string `json:"source_site"`
 	AttributionDestination string `json:"attribution_destination"`
@@ -72,6 +121,33 @@ type SharedInfo struct {
 	DebugMode              bool   `json:"debug_mode"`
 }
 
+// PrivateAggregationReport contains the information generated by a Protected Audience or
+// Shared Storage worklet through the Private Aggregation API. Unlike AggregatableReport, it
+// carries no attribution source/trigger fields.
+type PrivateAggregationReport struct {
+	// SharedInfo is a JSON serialized instance of struct PrivateAggregationSharedInfo, used as
+	// the authenticated data for decryption, the same way it is for AggregatableReport.
+	SharedInfo                 string                       `json:"shared_info"`
+	AggregationServicePayloads []*AggregationServicePayload `json:"aggregation_service_payloads"`
+
+	// DebugKey is empty for non-debug reports.
+	DebugKey string `json:"debug_key"`
+}
+
+// PrivateAggregationSharedInfo contains the shared information for a Private Aggregation API
+// report. It has an API field identifying the calling context instead of the attribution
+// source registration time carried by SharedInfo.
+type PrivateAggregationSharedInfo struct {
+	ScheduledReportTime string `json:"scheduled_report_time"`
+	PrivacyBudgetKey    string `json:"privacy_budget_key"`
+	Version             string `json:"version"`
+	ReportID            string `json:"report_id"`
+	ReportingOrigin     string `json:"reporting_origin"`
+	// API is one of APIProtectedAudience or APISharedStorage.
+	API       string `json:"api"`
+	DebugMode bool   `json:"debug_mode"`
+}
+
 // Contribution contains a single histogram contribution.
 type Contribution struct {
 	Bucket []byte `json:"bucket"`
@@ -88,38 +164,29 @@ type Payload struct {
 	Data []Contribution `json:"data"`
 }
 
-// GetProtocol gets the protocol which the report uses.
-func (r *AggregatableReport) GetProtocol() (string, error) {
+func getProtocol(payloads []*AggregationServicePayload) (string, error) {
 	var protocol string
-	switch len(r.AggregationServicePayloads) {
+	switch len(payloads) {
 	case 1:
 		protocol = onepartyProtocol
 	case 2:
 		protocol = mpcProtocol
 	default:
-		return "", fmt.Errorf("expect 1 or 2 payloads, got %d", len(r.AggregationServicePayloads))
+		return "", fmt.Errorf("expect 1 or 2 payloads, got %d", len(payloads))
 	}
 	return protocol, nil
 }
 
-// Validate checks if a report is valid.
-func (r *AggregatableReport) Validate() error {
-	if got := len(r.AggregationServicePayloads); got != 1 && got != 2 {
+func validatePayloads(payloads []*AggregationServicePayload) error {
+	if got := len(payloads); got != 1 && got != 2 {
 		return fmt.Errorf("expected one or two payloads, got %d", got)
 	}
-
 	return nil
 }
 
-// IsDebugReport checks if a report has a clear text debug payload.
-func (r *AggregatableReport) IsDebugReport() bool {
-	return r.AggregationServicePayloads[0].DebugCleartextPayload != ""
-}
-
-// ExtractPayloadsFromAggregatableReport extracts records to be processed by the aggregators.
-func (r *AggregatableReport) ExtractPayloadsFromAggregatableReport(useCleartext bool) ([]*pb.AggregatablePayload, error) {
+func extractPayloads(payloads []*AggregationServicePayload, sharedInfo string, useCleartext bool) ([]*pb.AggregatablePayload, error) {
 	var output []*pb.AggregatablePayload
-	for _, payload := range r.AggregationServicePayloads {
+	for _, payload := range payloads {
 		var (
 			data  []byte
 			err   error
@@ -136,15 +203,45 @@ func (r *AggregatableReport) ExtractPayloadsFromAggregatableReport(useCleartext
 		}
 		output = append(output, &pb.AggregatablePayload{
 			Payload:    &pb.StandardCiphertext{Data: data},
-			SharedInfo: r.SharedInfo,
+			SharedInfo: sharedInfo,
 			KeyId:      keyID,
 		})
 	}
 	return output, nil
 }
 
-func (r *AggregatableReport) convertReport(useCleartext bool) (map[string]string, error) {
-	payloads, err := r.ExtractPayloadsFromAggregatableReport(useCleartext)
+// verifyPayloadEnvelopes checks that every payload carries an envelope that verifies
+// against the Verifier verifiers has registered for reportingOrigin, and that the
+// enveloped payload matches the payload's own ciphertext.
+func verifyPayloadEnvelopes(payloads []*AggregationServicePayload, reportingOrigin string, verifiers OriginVerifiers) error {
+	verifier, ok := verifiers[reportingOrigin]
+	if !ok {
+		return fmt.Errorf("no verifier registered for reporting origin %q", reportingOrigin)
+	}
+
+	for _, payload := range payloads {
+		if payload.Envelope == nil {
+			return fmt.Errorf("payload for key %q is missing a required envelope", payload.KeyID)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(payload.Payload)
+		if err != nil {
+			return err
+		}
+
+		decoded, err := envelope.VerifyEnvelope(payload.Envelope, map[string]envelope.Verifier{verifier.KeyID(): verifier})
+		if err != nil {
+			return fmt.Errorf("reporting origin %q: %v", reportingOrigin, err)
+		}
+		if !bytes.Equal(decoded, raw) {
+			return fmt.Errorf("envelope payload does not match the aggregation service payload for key %q", payload.KeyID)
+		}
+	}
+	return nil
+}
+
+func convertReport(r Report, useCleartext bool, verifiers OriginVerifiers) (map[string]string, error) {
+	payloads, err := r.ExtractPayloadsFromAggregatableReport(useCleartext, verifiers)
 	if err != nil {
 		return nil, err
 	}
@@ -160,14 +257,138 @@ func (r *AggregatableReport) convertReport(useCleartext bool) (map[string]string
 	return output, nil
 }
 
+// GetProtocol gets the protocol which the report uses.
+func (r *AggregatableReport) GetProtocol() (string, error) {
+	return getProtocol(r.AggregationServicePayloads)
+}
+
+// Validate checks if a report is valid.
+func (r *AggregatableReport) Validate() error {
+	return validatePayloads(r.AggregationServicePayloads)
+}
+
+// IsDebugReport checks if a report has a clear text debug payload.
+func (r *AggregatableReport) IsDebugReport() bool {
+	return r.AggregationServicePayloads[0].DebugCleartextPayload != ""
+}
+
+// ExtractPayloadsFromAggregatableReport extracts records to be processed by the aggregators.
+func (r *AggregatableReport) ExtractPayloadsFromAggregatableReport(useCleartext bool, verifiers OriginVerifiers) ([]*pb.AggregatablePayload, error) {
+	if verifiers != nil {
+		var info SharedInfo
+		if err := json.Unmarshal([]byte(r.SharedInfo), &info); err != nil {
+			return nil, fmt.Errorf("parsing shared_info: %v", err)
+		}
+		if err := verifyPayloadEnvelopes(r.AggregationServicePayloads, info.ReportingOrigin, verifiers); err != nil {
+			return nil, err
+		}
+	}
+	return extractPayloads(r.AggregationServicePayloads, r.SharedInfo, useCleartext)
+}
+
 // GetSerializedEncryptedRecords extracts and serializes the encrypted payloads.
-func (r *AggregatableReport) GetSerializedEncryptedRecords() (map[string]string, error) {
-	return r.convertReport(false /*useCleartext*/)
+func (r *AggregatableReport) GetSerializedEncryptedRecords(verifiers OriginVerifiers) (map[string]string, error) {
+	return convertReport(r, false /*useCleartext*/, verifiers)
 }
 
 // GetSerializedCleartextRecords extracts and serializes the cleartext payloads.
-func (r *AggregatableReport) GetSerializedCleartextRecords() (map[string]string, error) {
-	return r.convertReport(true /*useCleartext*/)
+func (r *AggregatableReport) GetSerializedCleartextRecords(verifiers OriginVerifiers) (map[string]string, error) {
+	return convertReport(r, true /*useCleartext*/, verifiers)
+}
+
+// GetProtocol gets the protocol which the report uses.
+func (r *PrivateAggregationReport) GetProtocol() (string, error) {
+	return getProtocol(r.AggregationServicePayloads)
+}
+
+// Validate checks if a report is valid.
+func (r *PrivateAggregationReport) Validate() error {
+	return validatePayloads(r.AggregationServicePayloads)
+}
+
+// IsDebugReport checks if a report has a clear text debug payload.
+func (r *PrivateAggregationReport) IsDebugReport() bool {
+	return r.AggregationServicePayloads[0].DebugCleartextPayload != ""
+}
+
+// ExtractPayloadsFromAggregatableReport extracts records to be processed by the aggregators.
+func (r *PrivateAggregationReport) ExtractPayloadsFromAggregatableReport(useCleartext bool, verifiers OriginVerifiers) ([]*pb.AggregatablePayload, error) {
+	if verifiers != nil {
+		var info PrivateAggregationSharedInfo
+		if err := json.Unmarshal([]byte(r.SharedInfo), &info); err != nil {
+			return nil, fmt.Errorf("parsing shared_info: %v", err)
+		}
+		if err := verifyPayloadEnvelopes(r.AggregationServicePayloads, info.ReportingOrigin, verifiers); err != nil {
+			return nil, err
+		}
+	}
+	return extractPayloads(r.AggregationServicePayloads, r.SharedInfo, useCleartext)
+}
+
+// GetSerializedEncryptedRecords extracts and serializes the encrypted payloads.
+func (r *PrivateAggregationReport) GetSerializedEncryptedRecords(verifiers OriginVerifiers) (map[string]string, error) {
+	return convertReport(r, false /*useCleartext*/, verifiers)
+}
+
+// GetSerializedCleartextRecords extracts and serializes the cleartext payloads.
+func (r *PrivateAggregationReport) GetSerializedCleartextRecords(verifiers OriginVerifiers) (map[string]string, error) {
+	return convertReport(r, true /*useCleartext*/, verifiers)
+}
+
+// ParseReport unmarshals the body POSTed to a collector endpoint into the concrete Report
+// implementation for that endpoint, detecting the report kind from the endpoint path and,
+// if the path is not one of the well-known endpoints, from the report's shared_info.
+func ParseReport(endpointPath string, body []byte) (Report, error) {
+	switch {
+	case strings.HasSuffix(endpointPath, EndpointAttributionReporting):
+		r := &AggregatableReport{}
+		if err := json.Unmarshal(body, r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case strings.HasSuffix(endpointPath, EndpointPrivateAggregationProtectedAudience),
+		strings.HasSuffix(endpointPath, EndpointPrivateAggregationSharedStorage):
+		r := &PrivateAggregationReport{}
+		if err := json.Unmarshal(body, r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	default:
+		return parseReportFromSharedInfo(body)
+	}
+}
+
+// parseReportFromSharedInfo is the fallback used when the endpoint path the report was
+// received on does not identify a well-known endpoint, peeking at the report's shared_info
+// to tell an Attribution Reporting report apart from a Private Aggregation one.
+func parseReportFromSharedInfo(body []byte) (Report, error) {
+	var wrapper struct {
+		SharedInfo string `json:"shared_info"`
+	}
+	if err := json.Unmarshal(body, &wrapper); err != nil {
+		return nil, err
+	}
+
+	var probe struct {
+		API string `json:"api"`
+	}
+	if err := json.Unmarshal([]byte(wrapper.SharedInfo), &probe); err != nil {
+		return nil, fmt.Errorf("parsing shared_info: %v", err)
+	}
+
+	if probe.API == APIProtectedAudience || probe.API == APISharedStorage {
+		r := &PrivateAggregationReport{}
+		if err := json.Unmarshal(body, r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	r := &AggregatableReport{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 // SerializeAggregatablePayload serializes the AggregatablePayload into a string.
@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporttypes
+
+import (
+	"testing"
+)
+
+func attributionReportJSON() []byte {
+	return []byte(`{
+		"source_site": "https://source.test",
+		"attribution_destination": "https://destination.test",
+		"shared_info": "{\"scheduled_report_time\":\"1\",\"version\":\"1\",\"report_id\":\"r1\",\"reporting_origin\":\"https://reporter.test\"}",
+		"aggregation_service_payloads": [{"payload": "AA==", "key_id": "key1"}]
+	}`)
+}
+
+func privateAggregationReportJSON(api string) []byte {
+	return []byte(`{
+		"shared_info": "{\"scheduled_report_time\":\"1\",\"version\":\"1\",\"report_id\":\"r2\",\"reporting_origin\":\"https://reporter.test\",\"api\":\"` + api + `\"}",
+		"aggregation_service_payloads": [{"payload": "AA==", "key_id": "key1"}]
+	}`)
+}
+
+func TestParseReportByEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		body     []byte
+		want     Report
+	}{
+		{
+			name:     "attribution reporting endpoint",
+			endpoint: "/" + EndpointAttributionReporting,
+			body:     attributionReportJSON(),
+			want:     &AggregatableReport{},
+		},
+		{
+			name:     "protected audience endpoint",
+			endpoint: "/" + EndpointPrivateAggregationProtectedAudience,
+			body:     privateAggregationReportJSON(APIProtectedAudience),
+			want:     &PrivateAggregationReport{},
+		},
+		{
+			name:     "shared storage endpoint",
+			endpoint: "/" + EndpointPrivateAggregationSharedStorage,
+			body:     privateAggregationReportJSON(APISharedStorage),
+			want:     &PrivateAggregationReport{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseReport(tc.endpoint, tc.body)
+			if err != nil {
+				t.Fatalf("ParseReport() failed: %v", err)
+			}
+
+			switch tc.want.(type) {
+			case *AggregatableReport:
+				if _, ok := got.(*AggregatableReport); !ok {
+					t.Errorf("ParseReport() = %T, want *AggregatableReport", got)
+				}
+			case *PrivateAggregationReport:
+				if _, ok := got.(*PrivateAggregationReport); !ok {
+					t.Errorf("ParseReport() = %T, want *PrivateAggregationReport", got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseReportFallsBackToSharedInfo(t *testing.T) {
+	got, err := ParseReport("/some/unrecognized/endpoint", privateAggregationReportJSON(APIProtectedAudience))
+	if err != nil {
+		t.Fatalf("ParseReport() failed: %v", err)
+	}
+	if _, ok := got.(*PrivateAggregationReport); !ok {
+		t.Errorf("ParseReport() = %T, want *PrivateAggregationReport", got)
+	}
+
+	got, err = ParseReport("/some/unrecognized/endpoint", attributionReportJSON())
+	if err != nil {
+		t.Fatalf("ParseReport() failed: %v", err)
+	}
+	if _, ok := got.(*AggregatableReport); !ok {
+		t.Errorf("ParseReport() = %T, want *AggregatableReport", got)
+	}
+}
+
+func TestPrivateAggregationReportGetProtocolAndValidate(t *testing.T) {
+	r := &PrivateAggregationReport{
+		SharedInfo: `{"reporting_origin":"https://reporter.test"}`,
+		AggregationServicePayloads: []*AggregationServicePayload{
+			{Payload: "AA==", KeyID: "key1"},
+		},
+	}
+
+	if err := r.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %v", err)
+	}
+
+	protocol, err := r.GetProtocol()
+	if err != nil {
+		t.Fatalf("GetProtocol() failed: %v", err)
+	}
+	if protocol != onepartyProtocol {
+		t.Errorf("GetProtocol() = %q, want %q", protocol, onepartyProtocol)
+	}
+}